@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/tailscale/hujson"
+)
+
+// SinkConfig describes one configured delivery destination: the sink itself
+// (type + credentials) and the filter controlling which posts reach it.
+type SinkConfig struct {
+	Name string `json:"name"` // used in logs; defaults to Type if empty
+	Type string `json:"type"` // "slack", "discord", "matrix", "irc", or "webhook"
+
+	URL         string `json:"url"`                    // webhook URL (slack, discord, irc bridge, generic)
+	AccessToken string `json:"access_token,omitempty"` // matrix
+	RoomID      string `json:"room_id,omitempty"`      // matrix
+
+	Watch     []string `json:"watch,omitempty"` // watch expressions, or "/regex/" patterns; OR'd together
+	Langs     []string `json:"langs,omitempty"` // allowed BCP-47 langs; empty allows all
+	AllowDIDs []string `json:"allow_dids,omitempty"`
+	DenyDIDs  []string `json:"deny_dids,omitempty"`
+}
+
+// SinksConfig is the root of a --sinks-config file.
+type SinksConfig struct {
+	Sinks []SinkConfig `json:"sinks"`
+}
+
+// loadSinksConfig reads and parses a --sinks-config file. The file is HuJSON
+// (JSON plus comments and trailing commas), so plain JSON is also accepted.
+func loadSinksConfig(path string) (*SinksConfig, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	std, err := hujson.Standardize(raw)
+	if err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	var cfg SinksConfig
+	if err := json.Unmarshal(std, &cfg); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	if len(cfg.Sinks) == 0 {
+		return nil, fmt.Errorf("%s: no sinks configured", path)
+	}
+	return &cfg, nil
+}
+
+// buildRouter constructs a Sink for each entry in cfg and wires them into a
+// Router along with their per-sink filters.
+func buildRouter(client *http.Client, cfg *SinksConfig) (*Router, error) {
+	entries := make(map[Sink]SinkConfig, len(cfg.Sinks))
+	for _, sc := range cfg.Sinks {
+		sink, err := newSink(client, sc)
+		if err != nil {
+			return nil, fmt.Errorf("sink %q: %w", sc.Name, err)
+		}
+		entries[sink] = sc
+	}
+	return NewRouter(entries)
+}
+
+// newSink constructs the Sink implementation named by cfg.Type.
+func newSink(client *http.Client, cfg SinkConfig) (Sink, error) {
+	switch cfg.Type {
+	case "slack":
+		return &SlackSink{httpClient: client, webhookURL: cfg.URL, name: cfg.Name}, nil
+	case "discord":
+		return &DiscordSink{httpClient: client, webhookURL: cfg.URL, name: cfg.Name}, nil
+	case "matrix":
+		return &MatrixSink{httpClient: client, homeserverURL: cfg.URL, accessToken: cfg.AccessToken, roomID: cfg.RoomID, name: cfg.Name}, nil
+	case "irc":
+		return &IRCSink{httpClient: client, bridgeURL: cfg.URL, name: cfg.Name}, nil
+	case "webhook":
+		return &WebhookSink{httpClient: client, url: cfg.URL, name: cfg.Name}, nil
+	default:
+		return nil, fmt.Errorf("unknown sink type %q", cfg.Type)
+	}
+}
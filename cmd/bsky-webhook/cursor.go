@@ -0,0 +1,222 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// cursorSaveInterval is how often a CursorStore persists its position to
+// disk, trading a small amount of possible replay on crash for not writing
+// on every message.
+const cursorSaveInterval = 5 * time.Second
+
+// resumeBackdate is how far before the saved cursor a reconnect asks
+// Jetstream to resume from, so events that arrived in the last few seconds
+// before a crash or save tick aren't lost.
+const resumeBackdate = 5 * time.Second
+
+// CursorStore tracks the highest Jetstream time_us processed so far and
+// persists it to disk periodically, so a restart can resume near where it
+// left off instead of replaying the whole stream or silently skipping
+// whatever happened while the process was down.
+type CursorStore struct {
+	path string
+	last atomic.Int64
+}
+
+// LoadCursorStore reads a previously saved cursor from path, if it exists.
+// path may be empty, in which case the returned store never persists.
+func LoadCursorStore(path string) (*CursorStore, error) {
+	s := &CursorStore{path: path}
+	if path == "" {
+		return s, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return s, nil
+		}
+		return nil, fmt.Errorf("read cursor file %s: %w", path, err)
+	}
+	var saved struct {
+		TimeUs int64 `json:"time_us"`
+	}
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return nil, fmt.Errorf("parse cursor file %s: %w", path, err)
+	}
+	s.last.Store(saved.TimeUs)
+	return s, nil
+}
+
+// Observe records timeUs as processed, advancing the stored cursor if it's
+// the highest seen so far.
+func (s *CursorStore) Observe(timeUs int64) {
+	for {
+		cur := s.last.Load()
+		if timeUs <= cur {
+			return
+		}
+		if s.last.CompareAndSwap(cur, timeUs) {
+			return
+		}
+	}
+}
+
+// Resume returns the time_us to ask Jetstream to resume from on reconnect,
+// backdated by resumeBackdate, or 0 if nothing has been observed yet.
+func (s *CursorStore) Resume() int64 {
+	last := s.last.Load()
+	if last == 0 {
+		return 0
+	}
+	if backdated := last - resumeBackdate.Microseconds(); backdated > 0 {
+		return backdated
+	}
+	return last
+}
+
+// Run persists the cursor to path every cursorSaveInterval until ctx is
+// done, and once more on the way out so the final position isn't lost. It
+// returns immediately if the store has no path.
+func (s *CursorStore) Run(ctx context.Context) {
+	if s.path == "" {
+		return
+	}
+
+	var lastSaved int64
+	t := time.NewTicker(cursorSaveInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			s.save(&lastSaved)
+			return
+		case <-t.C:
+			s.save(&lastSaved)
+		}
+	}
+}
+
+func (s *CursorStore) save(lastSaved *int64) {
+	cur := s.last.Load()
+	if cur == *lastSaved {
+		return
+	}
+	data, err := json.Marshal(struct {
+		TimeUs int64 `json:"time_us"`
+	}{TimeUs: cur})
+	if err != nil {
+		slog.Error("marshal cursor", "err", err)
+		return
+	}
+	if err := os.WriteFile(s.path, data, 0600); err != nil {
+		slog.Error("persist cursor", "path", s.path, "err", err)
+		return
+	}
+	*lastSaved = cur
+}
+
+// dedupeCapacity bounds how many (DID, Rkey) pairs are remembered to filter
+// out events Jetstream replays around a resume cursor.
+const dedupeCapacity = 4096
+
+// seenKey identifies a single post for de-duplication purposes.
+type seenKey struct {
+	DID  string
+	Rkey string
+}
+
+// seenLRU is a bounded, concurrency-safe least-recently-used set.
+type seenLRU struct {
+	mu       sync.Mutex
+	capacity int
+	order    *list.List
+	elems    map[seenKey]*list.Element
+}
+
+func newSeenLRU(capacity int) *seenLRU {
+	return &seenLRU{
+		capacity: capacity,
+		order:    list.New(),
+		elems:    make(map[seenKey]*list.Element, capacity),
+	}
+}
+
+// Seen records key and reports whether it had already been recorded, so a
+// replayed event's second appearance comes back true.
+func (l *seenLRU) Seen(key seenKey) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if elem, ok := l.elems[key]; ok {
+		l.order.MoveToFront(elem)
+		return true
+	}
+
+	l.elems[key] = l.order.PushFront(key)
+	if l.order.Len() > l.capacity {
+		oldest := l.order.Back()
+		l.order.Remove(oldest)
+		delete(l.elems, oldest.Value.(seenKey))
+	}
+	return false
+}
+
+// nextBackoff computes a decorrelated-jitter reconnect delay: sleep =
+// min(cap, random_between(base, prev*3)). Pass prev=0 to start at base.
+// https://aws.amazon.com/blogs/architecture/exponential-backoff-and-jitter/
+func nextBackoff(prev time.Duration) time.Duration {
+	const (
+		backoffBase = 500 * time.Millisecond
+		backoffCap  = 60 * time.Second
+	)
+	if prev < backoffBase {
+		prev = backoffBase
+	}
+	next := backoffBase + time.Duration(rand.Int63n(int64(3*prev-backoffBase)))
+	if next > backoffCap {
+		next = backoffCap
+	}
+	return next
+}
+
+// lagLogInterval throttles how often the reader loop logs its lag behind
+// Jetstream, so a healthy consumer doesn't spam logs every message.
+const lagLogInterval = 30 * time.Second
+
+// pipeline bundles the state shared across every reconnect attempt: the sink
+// router, optional rules script, durable cursor, and replay de-duplication
+// cache.
+type pipeline struct {
+	router *Router
+	rules  *RulesEngine
+	cursor *CursorStore
+	seen   *seenLRU
+
+	lastLagLog atomic.Int64 // UnixNano of the last lag log line
+}
+
+// observe records eventTimeUs as processed and occasionally logs how far
+// behind the live stream the consumer is running.
+func (p *pipeline) observe(eventTimeUs int64) {
+	p.cursor.Observe(eventTimeUs)
+
+	now := time.Now()
+	last := p.lastLagLog.Load()
+	if last != 0 && now.Sub(time.Unix(0, last)) < lagLogInterval {
+		return
+	}
+	if !p.lastLagLog.CompareAndSwap(last, now.UnixNano()) {
+		return
+	}
+	slog.Info("jetstream lag", "lag", now.Sub(time.UnixMicro(eventTimeUs)))
+}
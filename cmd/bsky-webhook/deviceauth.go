@@ -0,0 +1,341 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	bluesky "github.com/tailscale/go-bluesky"
+)
+
+// Standard device grant error codes, per RFC 8628 section 3.5.
+const (
+	errAuthorizationPending = "authorization_pending"
+	errSlowDown             = "slow_down"
+	errExpiredToken         = "expired_token"
+	errAccessDenied         = "access_denied"
+)
+
+// DeviceTokenBundle is the result of an OAuth 2.0 Device Authorization Grant
+// login, cached to disk so a process restart doesn't require the operator to
+// re-approve the login out of band.
+type DeviceTokenBundle struct {
+	AccessToken  string    `json:"access_token"`
+	RefreshToken string    `json:"refresh_token"`
+	ExpiresAt    time.Time `json:"expires_at"`
+}
+
+// expiresWithin reports whether the bundle is nil or its access token expires
+// at or before d from now.
+func (b *DeviceTokenBundle) expiresWithin(d time.Duration) bool {
+	return b == nil || time.Until(b.ExpiresAt) <= d
+}
+
+type deviceAuthorizationResponse struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete"`
+	ExpiresIn               int    `json:"expires_in"`
+	Interval                int    `json:"interval"`
+}
+
+type oauthTokenResponse struct {
+	AccessToken      string `json:"access_token"`
+	RefreshToken     string `json:"refresh_token"`
+	ExpiresIn        int    `json:"expires_in"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+// deviceGrantError wraps a token-endpoint error response so callers can
+// distinguish the standard device grant codes from transport failures.
+type deviceGrantError struct {
+	code, description string
+}
+
+func (e *deviceGrantError) Error() string {
+	if e.description != "" {
+		return fmt.Sprintf("%s: %s", e.code, e.description)
+	}
+	return e.code
+}
+
+// requestDeviceCode starts a device authorization grant by asking the PDS for
+// a device/user code pair that the operator can approve out of band.
+func requestDeviceCode(ctx context.Context, client *http.Client, serverURL, clientID string, scopes []string) (*deviceAuthorizationResponse, error) {
+	form := url.Values{
+		"client_id": {clientID},
+		"scope":     {strings.Join(scopes, " ")},
+	}
+	res, err := postForm(ctx, client, serverURL+"/oauth/device/authorize", form)
+	if err != nil {
+		return nil, fmt.Errorf("device authorization request: %w", err)
+	}
+	defer res.Body.Close()
+
+	var out deviceAuthorizationResponse
+	if err := json.NewDecoder(res.Body).Decode(&out); err != nil {
+		return nil, fmt.Errorf("decode device authorization response: %w", err)
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("device authorization: server returned %s", res.Status)
+	}
+	if out.Interval <= 0 {
+		out.Interval = 5
+	}
+	return &out, nil
+}
+
+// pollDeviceToken polls the PDS token endpoint until the operator approves
+// (or denies) the pending device code, honoring the standard device grant
+// errors: it keeps polling on authorization_pending, backs off on slow_down,
+// and fails on expired_token or access_denied.
+func pollDeviceToken(ctx context.Context, client *http.Client, serverURL, clientID, deviceCode string, interval time.Duration) (*DeviceTokenBundle, error) {
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(interval):
+		}
+
+		form := url.Values{
+			"client_id":   {clientID},
+			"grant_type":  {"urn:ietf:params:oauth:grant-type:device_code"},
+			"device_code": {deviceCode},
+		}
+		bundle, err := doTokenRequest(ctx, client, serverURL, form)
+		if err == nil {
+			return bundle, nil
+		}
+
+		var grantErr *deviceGrantError
+		if !errors.As(err, &grantErr) {
+			return nil, err
+		}
+		switch grantErr.code {
+		case errAuthorizationPending:
+			// keep polling at the same interval
+		case errSlowDown:
+			interval += 5 * time.Second
+		case errExpiredToken, errAccessDenied:
+			return nil, err
+		default:
+			return nil, err
+		}
+	}
+}
+
+// refreshDeviceToken exchanges a refresh token for a new access/refresh token
+// pair, used both proactively near expiry and to resume a session on restart.
+func refreshDeviceToken(ctx context.Context, client *http.Client, serverURL, clientID string, bundle *DeviceTokenBundle) (*DeviceTokenBundle, error) {
+	form := url.Values{
+		"client_id":     {clientID},
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {bundle.RefreshToken},
+	}
+	return doTokenRequest(ctx, client, serverURL, form)
+}
+
+func doTokenRequest(ctx context.Context, client *http.Client, serverURL string, form url.Values) (*DeviceTokenBundle, error) {
+	res, err := postForm(ctx, client, serverURL+"/oauth/token", form)
+	if err != nil {
+		return nil, fmt.Errorf("token request: %w", err)
+	}
+	defer res.Body.Close()
+
+	var out oauthTokenResponse
+	if err := json.NewDecoder(res.Body).Decode(&out); err != nil {
+		return nil, fmt.Errorf("decode token response: %w", err)
+	}
+	if out.Error != "" {
+		return nil, &deviceGrantError{code: out.Error, description: out.ErrorDescription}
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("token request: server returned %s", res.Status)
+	}
+	return &DeviceTokenBundle{
+		AccessToken:  out.AccessToken,
+		RefreshToken: out.RefreshToken,
+		ExpiresAt:    time.Now().Add(time.Duration(out.ExpiresIn) * time.Second),
+	}, nil
+}
+
+func postForm(ctx context.Context, client *http.Client, target string, form url.Values) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", target, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return client.Do(req)
+}
+
+// loadCachedTokenBundle reads a previously cached token bundle from disk, if
+// any. A missing file is not an error.
+func loadCachedTokenBundle(path string) (*DeviceTokenBundle, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var bundle DeviceTokenBundle
+	if err := json.Unmarshal(data, &bundle); err != nil {
+		return nil, fmt.Errorf("parse cached token bundle: %w", err)
+	}
+	return &bundle, nil
+}
+
+// saveTokenBundle persists a token bundle to disk with owner-only
+// permissions, since it carries live Bluesky credentials.
+func saveTokenBundle(path string, bundle *DeviceTokenBundle) error {
+	if path == "" {
+		return nil
+	}
+	data, err := json.Marshal(bundle)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0o600)
+}
+
+// deviceAuthLogin obtains a Bluesky OAuth token via the device authorization
+// grant, reusing (and refreshing) a cached bundle from a previous run when
+// possible so restarts don't require the operator to re-approve the login.
+func deviceAuthLogin(ctx context.Context, client *http.Client, serverURL, clientID string, scopes []string, cachePath string, notify func(userCode, verificationURI string)) (*DeviceTokenBundle, error) {
+	if cached, err := loadCachedTokenBundle(cachePath); err != nil {
+		slog.Warn("ignoring unreadable cached OAuth token", "err", err)
+	} else if cached != nil {
+		if !cached.expiresWithin(60 * time.Second) {
+			return cached, nil
+		}
+		if refreshed, err := refreshDeviceToken(ctx, client, serverURL, clientID, cached); err == nil {
+			if err := saveTokenBundle(cachePath, refreshed); err != nil {
+				slog.Warn("failed to cache refreshed OAuth token", "err", err)
+			}
+			return refreshed, nil
+		} else {
+			slog.Warn("cached OAuth token could not be refreshed, starting a new device login", "err", err)
+		}
+	}
+
+	auth, err := requestDeviceCode(ctx, client, serverURL, clientID, scopes)
+	if err != nil {
+		return nil, fmt.Errorf("start device authorization: %w", err)
+	}
+	notify(auth.UserCode, auth.VerificationURIComplete)
+
+	bundle, err := pollDeviceToken(ctx, client, serverURL, clientID, auth.DeviceCode, time.Duration(auth.Interval)*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("device authorization: %w", err)
+	}
+	if err := saveTokenBundle(cachePath, bundle); err != nil {
+		slog.Warn("failed to cache OAuth token", "err", err)
+	}
+	return bundle, nil
+}
+
+// watchTokenRefresh runs until ctx is canceled, proactively refreshing the
+// OAuth token shortly before it expires and re-injecting the result into
+// current so that subsequent API calls keep using a live token.
+func watchTokenRefresh(ctx context.Context, client *http.Client, serverURL, clientID, cachePath string, current *atomic.Pointer[DeviceTokenBundle]) {
+	const checkInterval = 30 * time.Second
+	const refreshWindow = 60 * time.Second
+
+	ticker := time.NewTicker(checkInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		bundle := current.Load()
+		if !bundle.expiresWithin(refreshWindow) {
+			continue
+		}
+		refreshed, err := refreshDeviceToken(ctx, client, serverURL, clientID, bundle)
+		if err != nil {
+			slog.Error("refresh OAuth token", "err", err)
+			continue
+		}
+		current.Store(refreshed)
+		if err := saveTokenBundle(cachePath, refreshed); err != nil {
+			slog.Warn("failed to cache refreshed OAuth token", "err", err)
+		}
+	}
+}
+
+// oauthProfileFetcher fetches Bluesky profiles directly over XRPC using a
+// live OAuth device-grant token. It exists because go-bluesky's Client only
+// knows how to mint its own app-password sessions and has no way to accept an
+// externally-obtained token, so device-auth mode cannot reuse it directly.
+type oauthProfileFetcher struct {
+	httpClient *http.Client
+	serverURL  string
+	token      *atomic.Pointer[DeviceTokenBundle]
+}
+
+func (f *oauthProfileFetcher) FetchProfile(ctx context.Context, id string) (*bluesky.Profile, error) {
+	target := f.serverURL + "/xrpc/app.bsky.actor.getProfile?actor=" + url.QueryEscape(id)
+	req, err := http.NewRequestWithContext(ctx, "GET", target, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+f.token.Load().AccessToken)
+
+	res, err := f.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(res.Body)
+		return nil, fmt.Errorf("get profile: %s: %s", res.Status, body)
+	}
+
+	var raw actorProfileResponse
+	if err := json.NewDecoder(res.Body).Decode(&raw); err != nil {
+		return nil, fmt.Errorf("decode profile response: %w", err)
+	}
+	return raw.toProfile(), nil
+}
+
+func (f *oauthProfileFetcher) Close() error { return nil }
+
+// actorProfileResponse mirrors the subset of app.bsky.actor.getProfile's
+// output that the webhook needs.
+type actorProfileResponse struct {
+	Did         string `json:"did"`
+	Handle      string `json:"handle"`
+	DisplayName string `json:"displayName"`
+	Avatar      string `json:"avatar"`
+	Viewer      struct {
+		Muted bool `json:"muted"`
+	} `json:"viewer"`
+}
+
+func (r *actorProfileResponse) toProfile() *bluesky.Profile {
+	return &bluesky.Profile{
+		Handle:    r.Handle,
+		DID:       r.Did,
+		Name:      r.DisplayName,
+		AvatarURL: r.Avatar,
+		Viewer:    bluesky.Viewer{Muted: r.Viewer.Muted},
+	}
+}
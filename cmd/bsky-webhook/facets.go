@@ -3,6 +3,7 @@ package main
 import (
 	"cmp"
 	"fmt"
+	"html"
 	"slices"
 	"strings"
 )
@@ -22,19 +23,55 @@ func (b BskyTextFragment) featureURI() string {
 }
 
 func bskyMessageToSlackMarkup(msg BskyMessage) (string, error) {
-	var sb strings.Builder
+	return renderFacetedText(msg, func(uri, text string) string {
+		return fmt.Sprintf("<%s|%s>", uri, text)
+	})
+}
+
+// bskyMessageToDiscordMarkup renders a post's facets as Discord's masked-link
+// markdown, usable inside an embed description.
+func bskyMessageToDiscordMarkup(msg BskyMessage) (string, error) {
+	return renderFacetedText(msg, func(uri, text string) string {
+		return fmt.Sprintf("[%s](%s)", escapeDiscordLinkText(text), uri)
+	})
+}
+
+// discordLinkTextReplacer escapes the characters that would otherwise close
+// a Discord masked link's `[text]` span early.
+var discordLinkTextReplacer = strings.NewReplacer("[", `\[`, "]", `\]`)
 
+func escapeDiscordLinkText(text string) string {
+	return discordLinkTextReplacer.Replace(text)
+}
+
+// bskyMessageToMatrixHTML renders a post's facets as escaped HTML suitable
+// for a Matrix m.room.message formatted_body.
+func bskyMessageToMatrixHTML(msg BskyMessage) (string, error) {
+	return renderFacetedText(msg, func(uri, text string) string {
+		return fmt.Sprintf(`<a href="%s">%s</a>`, html.EscapeString(uri), html.EscapeString(text))
+	}, html.EscapeString)
+}
+
+// renderFacetedText walks a post's text fragments, rendering linked fragments
+// through linkFn and (optionally) passing plain fragments through escapeFn
+// first.
+func renderFacetedText(msg BskyMessage, linkFn func(uri, text string) string, escapeFn ...func(string) string) (string, error) {
 	fragments, err := facetsToFragments(msg)
 	if err != nil {
 		return "", err
 	}
 
+	var sb strings.Builder
 	for _, frag := range fragments {
+		text := frag.Text
 		if uri := frag.featureURI(); uri != "" {
-			fmt.Fprintf(&sb, "<%s|%s>", uri, frag.Text)
-		} else {
-			sb.WriteString(frag.Text)
+			sb.WriteString(linkFn(uri, text))
+			continue
+		}
+		for _, escape := range escapeFn {
+			text = escape(text)
 		}
+		sb.WriteString(text)
 	}
 	return sb.String(), nil
 }
@@ -8,7 +8,6 @@ import (
 	"encoding/json"
 	"flag"
 	"fmt"
-	"io"
 	"log"
 	"log/slog"
 	"net/http"
@@ -18,6 +17,7 @@ import (
 	"path"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -35,13 +35,25 @@ var (
 	bskyHandle = flag.String("bsky-handle", envOr("BSKY_HANDLE", ""),
 		"bluesky handle for auth (required)")
 	bskyAppKey = flag.String("bsky-app-password", envOr("BSKY_APP_PASSWORD", ""),
-		"bluesky app password for auth (required)")
+		"bluesky app password for auth (required in app-password auth mode)")
+	authMode = flag.String("auth-mode", envOr("AUTH_MODE", "app-password"),
+		"bluesky auth mode: app-password or device")
+	oauthClientID = flag.String("bsky-oauth-client-id", envOr("BSKY_OAUTH_CLIENT_ID", ""),
+		"OAuth client_id to use for device authorization (required in device auth mode)")
+	oauthScopes = flag.String("bsky-oauth-scopes", envOr("BSKY_OAUTH_SCOPES", "atproto transition:generic"),
+		"space-separated OAuth scopes to request in device auth mode")
 	webhookURL = flag.String("slack-webhook-url", envOr("SLACK_WEBHOOK_URL", ""),
 		"slack webhook URL (required)")
 	bskyServerURL = flag.String("bsky-server-url", envOr("BSKY_SERVER_URL",
 		"https://bsky.social"), "bluesky PDS server URL")
 	watchWord = flag.String("watch-word", envOr("WATCH_WORD", "tailscale"),
-		"the word to watch out for. may be multiple words in future (required)")
+		"the watch expression to match posts against, e.g. "+
+			`'("tailscale" OR "headscale") AND NOT "spam" AND lang:en' (required)`)
+	sinksConfigPath = flag.String("sinks-config", envOr("SINKS_CONFIG", ""),
+		"path to a HuJSON file configuring one or more delivery sinks (if empty, a single "+
+			"Slack sink is built from --slack-webhook-url and --watch-word)")
+	rulesScriptPath = flag.String("rules-script", envOr("RULES_SCRIPT", ""),
+		"path to a Tengo script run against every post before the sink filters (optional)")
 
 	secretsURL = flag.String("secrets-url", envOr("SECRETS_URL", ""),
 		"the URL of a secrets server (if empty, no server is used)")
@@ -84,15 +96,19 @@ func main() {
 	// TODO(creachadair): Usage text.
 
 	switch {
-	case *webhookURL == "" && *secretsURL == "":
-		log.Fatal("missing slack webhook URL (SLACK_WEBHOOK_URL)")
+	case *sinksConfigPath == "" && *webhookURL == "" && *secretsURL == "":
+		log.Fatal("missing slack webhook URL (SLACK_WEBHOOK_URL), or use --sinks-config")
 	case *bskyServerURL == "":
 		log.Fatal("missing Bluesky server URL (BSKY_SERVER_URL)")
-	case *bskyHandle == "":
+	case *authMode != "app-password" && *authMode != "device":
+		log.Fatalf("invalid --auth-mode %q (want app-password or device)", *authMode)
+	case *authMode == "app-password" && *bskyHandle == "":
 		log.Fatal("Missing Bluesky account handle (BSKY_HANDLE)")
-	case *bskyAppKey == "" && *secretsURL == "":
+	case *authMode == "app-password" && *bskyAppKey == "" && *secretsURL == "":
 		log.Fatal("missing Bluesky app secret (BSKY_APP_PASSWORD)")
-	case *watchWord == "":
+	case *authMode == "device" && *oauthClientID == "":
+		log.Fatal("missing OAuth client ID for device auth mode (BSKY_OAUTH_CLIENT_ID)")
+	case *sinksConfigPath == "" && *watchWord == "":
 		log.Fatal("missing watchword")
 	}
 
@@ -129,22 +145,167 @@ func main() {
 		log.Printf("Fetched client secrets from %q", *secretsURL)
 	}
 
+	newFetcher, err := newProfileFetcherFactory(ctx)
+	if err != nil {
+		log.Fatalf("initialize Bluesky auth: %v", err)
+	}
+
+	router, err := newRouter()
+	if err != nil {
+		log.Fatalf("configure sinks: %v", err)
+	}
+
+	var rules *RulesEngine
+	if *rulesScriptPath != "" {
+		rules, err = NewRulesEngine(*rulesScriptPath)
+		if err != nil {
+			log.Fatalf("load rules script: %v", err)
+		}
+	}
+
+	var cursorPath string
+	if *tsStateDir != "" {
+		cursorPath = path.Join(*tsStateDir, "jetstream-cursor.json")
+	}
+	cursor, err := LoadCursorStore(cursorPath)
+	if err != nil {
+		log.Fatalf("load jetstream cursor: %v", err)
+	}
+	go cursor.Run(ctx)
+
+	p := &pipeline{router: router, rules: rules, cursor: cursor, seen: newSeenLRU(dedupeCapacity)}
+
 	nextAddr := nextWSAddress()
+	var backoff time.Duration
 	for ctx.Err() == nil {
+		query := url.Values{"wantedCollections": {"app.bsky.feed.post"}}
+		if resume := cursor.Resume(); resume > 0 {
+			query.Set("cursor", strconv.FormatInt(resume, 10))
+		}
 		wsURL := url.URL{
 			Scheme:   "wss",
 			Host:     nextAddr(),
 			Path:     "/subscribe",
-			RawQuery: "wantedCollections=app.bsky.feed.post",
+			RawQuery: query.Encode(),
 		}
 		slog.Info("ws connecting", "url", wsURL.String())
 
-		err := websocketConnection(ctx, wsURL)
+		before := cursor.Resume()
+		err := websocketConnection(ctx, wsURL, newFetcher, p)
 		slog.Error("ws connection", "url", wsURL, "err", err)
 
-		// TODO(erisa): exponential backoff
-		time.Sleep(2 * time.Second)
+		if cursor.Resume() > before {
+			backoff = 0
+		}
+		backoff = nextBackoff(backoff)
+		slog.Info("reconnecting", "after", backoff)
+		select {
+		case <-ctx.Done():
+		case <-time.After(backoff):
+		}
+	}
+}
+
+// newRouter builds the sink Router according to *sinksConfigPath, falling
+// back to a single Slack sink built from --slack-webhook-url/--watch-word
+// when no sinks config file is given.
+func newRouter() (*Router, error) {
+	cfg := &SinksConfig{
+		Sinks: []SinkConfig{{
+			Name:  "slack",
+			Type:  "slack",
+			URL:   *webhookURL,
+			Watch: []string{*watchWord},
+		}},
+	}
+	if *sinksConfigPath != "" {
+		var err error
+		cfg, err = loadSinksConfig(*sinksConfigPath)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return buildRouter(httpClient, cfg)
+}
+
+// profileFetcher is the subset of *bluesky.Client that readJetstreamMessage
+// needs. It's an interface so that --auth-mode=device can be served without
+// going through bluesky.Client, which only knows how to mint its own
+// app-password sessions.
+type profileFetcher interface {
+	FetchProfile(ctx context.Context, id string) (*bluesky.Profile, error)
+	Close() error
+}
+
+// newProfileFetcherFactory returns a function that establishes a new
+// authenticated profileFetcher, according to *authMode. For app-password auth
+// it dials and logs in to a fresh *bluesky.Client on every call, matching
+// websocketConnection's existing per-reconnect login. For device auth it runs
+// the OAuth device authorization grant once up front, keeps the resulting
+// token fresh in the background, and hands out lightweight fetchers that
+// share that live token.
+func newProfileFetcherFactory(ctx context.Context) (func(context.Context) (profileFetcher, error), error) {
+	if *authMode != "device" {
+		return func(ctx context.Context) (profileFetcher, error) {
+			bsky, err := bluesky.DialWithClient(ctx, *bskyServerURL, httpClient)
+			if err != nil {
+				return nil, fmt.Errorf("dial bsky: %w", err)
+			}
+			if err := bsky.Login(ctx, *bskyHandle, *bskyAppKey); err != nil {
+				bsky.Close()
+				return nil, fmt.Errorf("login bsky: %w", err)
+			}
+			return bsky, nil
+		}, nil
+	}
+
+	var cachePath string
+	if *tsStateDir != "" {
+		cachePath = path.Join(*tsStateDir, "bsky-oauth-token.json")
+	}
+
+	bundle, err := deviceAuthLogin(ctx, httpClient, *bskyServerURL, *oauthClientID, strings.Fields(*oauthScopes), cachePath, notifyDeviceCode)
+	if err != nil {
+		return nil, fmt.Errorf("device authorization: %w", err)
+	}
+
+	var token atomic.Pointer[DeviceTokenBundle]
+	token.Store(bundle)
+	go watchTokenRefresh(ctx, httpClient, *bskyServerURL, *oauthClientID, cachePath, &token)
+
+	return func(ctx context.Context) (profileFetcher, error) {
+		return &oauthProfileFetcher{httpClient: httpClient, serverURL: *bskyServerURL, token: &token}, nil
+	}, nil
+}
+
+// notifyDeviceCode prints the device authorization challenge to stderr and,
+// if a Slack webhook is configured, also posts it there so an operator can
+// approve the login out of band without shell access to the host.
+func notifyDeviceCode(userCode, verificationURI string) {
+	fmt.Fprintf(os.Stderr, "Bluesky device authorization required: enter code %s at %s\n", userCode, verificationURI)
+
+	if *webhookURL == "" {
+		return
+	}
+	body, err := json.Marshal(SlackBody{
+		Text: fmt.Sprintf("Bluesky device authorization required: enter code `%s` at <%s|this link>.", userCode, verificationURI),
+	})
+	if err != nil {
+		slog.Error("marshal device auth notice", "err", err)
+		return
+	}
+	req, err := http.NewRequest("POST", *webhookURL, bytes.NewReader(body))
+	if err != nil {
+		slog.Error("build device auth notice", "err", err)
+		return
 	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := httpClient.Do(req)
+	if err != nil {
+		slog.Error("post device auth notice to slack", "err", err)
+		return
+	}
+	res.Body.Close()
 }
 
 func envOr(key, defaultVal string) string {
@@ -171,7 +332,7 @@ func nextWSAddress() func() string {
 	}
 }
 
-func websocketConnection(ctx context.Context, wsUrl url.URL) error {
+func websocketConnection(ctx context.Context, wsUrl url.URL, newFetcher func(context.Context) (profileFetcher, error), p *pipeline) error {
 	// add compression headers
 	headers := http.Header{}
 	headers.Add("Socket-Encoding", "zstd")
@@ -186,17 +347,12 @@ func websocketConnection(ctx context.Context, wsUrl url.URL) error {
 		return nil
 	})
 
-	bsky, err := bluesky.DialWithClient(ctx, *bskyServerURL, httpClient)
+	bsky, err := newFetcher(ctx)
 	if err != nil {
-		return fmt.Errorf("dial bsky: %w", err)
+		return fmt.Errorf("connect bsky: %w", err)
 	}
 	defer bsky.Close()
 
-	err = bsky.Login(ctx, *bskyHandle, *bskyAppKey)
-	if err != nil {
-		return fmt.Errorf("login bsky: %w", err)
-	}
-
 	for ctx.Err() == nil {
 		// bail if we take too long for a read
 		c.SetReadDeadline(time.Now().Add(time.Second * 5))
@@ -206,7 +362,7 @@ func websocketConnection(ctx context.Context, wsUrl url.URL) error {
 			return err
 		}
 
-		err = readJetstreamMessage(ctx, jetstreamMessage, bsky)
+		err = readJetstreamMessage(ctx, jetstreamMessage, bsky, p)
 		if err != nil {
 			msg := jetstreamMessage[:min(32, len(jetstreamMessage))]
 			log.Printf("error reading jetstream message %q: %v", msg, err)
@@ -216,7 +372,7 @@ func websocketConnection(ctx context.Context, wsUrl url.URL) error {
 	return ctx.Err()
 }
 
-func readJetstreamMessage(ctx context.Context, jetstreamMessageEncoded []byte, bsky *bluesky.Client) error {
+func readJetstreamMessage(ctx context.Context, jetstreamMessageEncoded []byte, bsky profileFetcher, p *pipeline) error {
 	// Decompress the message
 	m, err := zstdDecoder.DecodeAll(jetstreamMessageEncoded, nil)
 	if err != nil {
@@ -230,12 +386,19 @@ func readJetstreamMessage(ctx context.Context, jetstreamMessageEncoded []byte, b
 	if err != nil {
 		return err
 	}
+	p.observe(bskyMessage.Time)
 
 	// we can ignore these messages
 	if bskyMessage.Kind != "commit" || bskyMessage.Commit == nil || bskyMessage.Commit.Operation != "create" || bskyMessage.Commit.Record == nil || bskyMessage.Commit.Rkey == "" {
 		return nil
 	}
 
+	// Jetstream may replay events we've already seen around a resume cursor;
+	// drop the duplicates rather than deliver them again.
+	if p.seen.Seen(seenKey{DID: bskyMessage.DID, Rkey: bskyMessage.Commit.Rkey}) {
+		return nil
+	}
+
 	// parse timestamp user provided when posting
 	postTime, err := time.Parse(time.RFC3339, bskyMessage.Commit.Record.CreatedAt)
 	if err != nil {
@@ -247,39 +410,68 @@ func readJetstreamMessage(ctx context.Context, jetstreamMessageEncoded []byte, b
 		return nil
 	}
 
-	if strings.Contains(strings.ToLower(bskyMessage.Commit.Record.Text), strings.ToLower(*watchWord)) {
-		jetstreamMessageStr := string(jetstreamMessage)
-
-		go func() {
-			profile, err := getBskyProfile(ctx, bskyMessage, bsky)
-			if err != nil {
-				slog.Error("fetch profile", "err", err, "msg", jetstreamMessageStr)
-				return
+	// Run the rules script, if configured, before the sink filters: it can
+	// drop the post outright, narrow which sinks see it, or rewrite its text.
+	var ruleResult RuleResult
+	if p.rules != nil {
+		res, err := p.rules.Eval(ctx, bskyMessage, "")
+		if err != nil {
+			slog.Warn("rules script error", "err", err, "msg", string(jetstreamMessage))
+		} else {
+			ruleResult = res
+			if ruleResult.Drop {
+				return nil
 			}
-
-			// ignore users that are muted by the bluesky account running the service
-			if profile.Viewer.Muted {
-				slog.Info("skipped post from muted user", "post", bskyMessage.toURL(&profile.Handle))
-				return
+			if ruleResult.HasTextOverride {
+				bskyMessage.Commit.Record.Text = ruleResult.TextOverride
 			}
+		}
+	}
 
-			var imageURL string
+	// Evaluate every sink's filter once per post, before doing any of the
+	// work needed to actually deliver it.
+	matched := p.router.Matching(bskyMessage)
+	if len(ruleResult.Sinks) > 0 {
+		matched = Named(matched, ruleResult.Sinks)
+	}
+	if len(matched) == 0 {
+		return nil
+	}
 
-			if len(bskyMessage.Commit.Record.Embed.Images) != 0 {
-				imageURL = fmt.Sprintf("https://cdn.bsky.app/img/feed_fullsize/plain/%s/%s", bskyMessage.DID, bskyMessage.Commit.Record.Embed.Images[0].Image.Ref.Link)
-			}
+	jetstreamMessageStr := string(jetstreamMessage)
 
-			err = sendToSlack(ctx, jetstreamMessageStr, bskyMessage, imageURL, *profile, postTime)
-			if err != nil {
-				slog.Error("slack error", "err", err)
-			}
-		}()
-	}
+	go func() {
+		profile, err := getBskyProfile(ctx, bskyMessage, bsky)
+		if err != nil {
+			slog.Error("fetch profile", "err", err, "msg", jetstreamMessageStr)
+			return
+		}
+
+		// ignore users that are muted by the bluesky account running the service
+		if profile.Viewer.Muted {
+			slog.Info("skipped post from muted user", "post", bskyMessage.toURL(&profile.Handle))
+			return
+		}
+
+		var imageURL string
+
+		if len(bskyMessage.Commit.Record.Embed.Images) != 0 {
+			imageURL = fmt.Sprintf("https://cdn.bsky.app/img/feed_fullsize/plain/%s/%s", bskyMessage.DID, bskyMessage.Commit.Record.Embed.Images[0].Image.Ref.Link)
+		}
+
+		p.router.Deliver(ctx, matched, RenderedPost{
+			Message:  bskyMessage,
+			Profile:  *profile,
+			ImageURL: imageURL,
+			PostTime: postTime,
+			Tags:     ruleResult.Tags,
+		})
+	}()
 
 	return nil
 }
 
-func getBskyProfile(ctx context.Context, bskyMessage BskyMessage, bsky *bluesky.Client) (*bluesky.Profile, error) {
+func getBskyProfile(ctx context.Context, bskyMessage BskyMessage, bsky profileFetcher) (*bluesky.Profile, error) {
 	profile, err := bsky.FetchProfile(ctx, bskyMessage.DID)
 	if err != nil {
 		return nil, err
@@ -297,58 +489,3 @@ func getBskyProfile(ctx context.Context, bskyMessage BskyMessage, bsky *bluesky.
 
 	return profile, nil
 }
-
-func sendToSlack(ctx context.Context, jetstreamMessageStr string, bskyMessage BskyMessage, imageURL string, profile bluesky.Profile, postTime time.Time) error {
-	var messageText string
-	var err error
-
-	messageText, err = bskyMessageToSlackMarkup(bskyMessage)
-	if err != nil {
-		return err
-	}
-
-	attachments := []SlackAttachment{
-		{
-			AuthorName: fmt.Sprintf("%s (@%s)", profile.Name, profile.Handle),
-			AuthorIcon: profile.AvatarURL,
-			AuthorLink: fmt.Sprintf("https://bsky.app/profile/%s", profile.Handle),
-			Text:       fmt.Sprintf("%s\n<%s|View post on Bluesky ↗>", messageText, bskyMessage.toURL(&profile.Handle)),
-			ImageUrl:   imageURL,
-			Footer:     "Posted",
-			Ts:         strconv.FormatInt(postTime.Unix(), 10),
-		},
-	}
-
-	body, err := json.Marshal(SlackBody{
-		Attachments: attachments,
-		UnfurlLinks: true,
-		UnfurlMedia: true,
-	})
-
-	if err != nil {
-		log.Printf("failed to marshal text: %v", err)
-
-	}
-	req, err := http.NewRequestWithContext(ctx, "POST", *webhookURL, bytes.NewReader(body))
-	if err != nil {
-		return err
-	}
-	req.Header.Set("Content-Type", "application/json")
-	res, err := httpClient.Do(req)
-	if err != nil {
-		slog.Error("failed to post to slack", "msg", jetstreamMessageStr)
-		return err
-	}
-	defer res.Body.Close()
-
-	if res.StatusCode != http.StatusOK {
-		body, err := io.ReadAll(res.Body)
-		if err != nil {
-			slog.Error("bad error code from slack and fail to read body", "statusCode", res.StatusCode, "msg", jetstreamMessageStr)
-			return err
-		}
-		slog.Error("error code response from slack", "statusCode", res.StatusCode, "responseBody", string(body), "msg", jetstreamMessageStr)
-		return fmt.Errorf("slack: %s %s", res.Status, string(body))
-	}
-	return nil
-}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// sinkFilter decides whether a post should be routed to a particular sink.
+// An empty filter matches every post.
+type sinkFilter struct {
+	exprs     []*WatchExpr     // boolean watch expressions, OR'd together
+	patterns  []*regexp.Regexp // legacy "/regex/" patterns matched against post text
+	allowDIDs map[string]bool  // if non-empty, only these DIDs may route here
+	denyDIDs  map[string]bool  // these DIDs never route here
+	langs     map[string]bool  // if non-empty, only these langs may route here
+}
+
+// newSinkFilter builds a sinkFilter from a sink's configuration. A watch
+// entry wrapped in slashes (e.g. "/tailscale|headscale/") is compiled as a
+// regex; anything else is compiled as a WatchExpr, e.g.
+// `("tailscale" OR "headscale") AND NOT "spam" AND lang:en`, or just a bare
+// word like "tailscale".
+func newSinkFilter(cfg SinkConfig) (*sinkFilter, error) {
+	f := &sinkFilter{
+		allowDIDs: toSet(cfg.AllowDIDs),
+		denyDIDs:  toSet(cfg.DenyDIDs),
+		langs:     toSet(cfg.Langs),
+	}
+	for _, w := range cfg.Watch {
+		if len(w) > 1 && strings.HasPrefix(w, "/") && strings.HasSuffix(w, "/") {
+			re, err := regexp.Compile(w[1 : len(w)-1])
+			if err != nil {
+				return nil, fmt.Errorf("bad watch regex %q: %w", w, err)
+			}
+			f.patterns = append(f.patterns, re)
+			continue
+		}
+		expr, err := ParseWatchExpr(w)
+		if err != nil {
+			return nil, err
+		}
+		f.exprs = append(f.exprs, expr)
+	}
+	return f, nil
+}
+
+func toSet(vals []string) map[string]bool {
+	if len(vals) == 0 {
+		return nil
+	}
+	set := make(map[string]bool, len(vals))
+	for _, v := range vals {
+		set[v] = true
+	}
+	return set
+}
+
+// Match reports whether msg should be routed to the sink this filter guards.
+// It only looks at fields available on the raw Jetstream message, so it can
+// run before the (comparatively expensive) profile lookup.
+func (f *sinkFilter) Match(msg BskyMessage) bool {
+	if f.denyDIDs[msg.DID] {
+		return false
+	}
+	if len(f.allowDIDs) > 0 && !f.allowDIDs[msg.DID] {
+		return false
+	}
+	if len(f.langs) > 0 && !f.anyLangMatches(msg.Commit.Record.Langs) {
+		return false
+	}
+	if len(f.exprs) == 0 && len(f.patterns) == 0 {
+		return true
+	}
+
+	for _, expr := range f.exprs {
+		if expr.Match(msg) {
+			return true
+		}
+	}
+	text := msg.Commit.Record.Text
+	for _, re := range f.patterns {
+		if re.MatchString(text) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *sinkFilter) anyLangMatches(langs []string) bool {
+	for _, lang := range langs {
+		if f.langs[lang] {
+			return true
+		}
+	}
+	return false
+}
+
+// routedSink pairs a Sink with the filter that gates delivery to it and the
+// rate limiter applied to its deliveries.
+type routedSink struct {
+	sink    Sink
+	filter  *sinkFilter
+	limiter *rate.Limiter
+}
+
+// Router fans a matched post out to every configured sink whose filter
+// accepts it.
+type Router struct {
+	routes []*routedSink
+}
+
+// NewRouter builds a Router from sinks paired with their filter configs.
+// Each sink is independently rate limited to 1 delivery/second with a burst
+// of 5, so a slow or rate-limited destination can't starve the others.
+func NewRouter(entries map[Sink]SinkConfig) (*Router, error) {
+	r := &Router{}
+	for sink, cfg := range entries {
+		filter, err := newSinkFilter(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("sink %q: %w", sink.Name(), err)
+		}
+		r.routes = append(r.routes, &routedSink{
+			sink:    sink,
+			filter:  filter,
+			limiter: rate.NewLimiter(1, 5),
+		})
+	}
+	return r, nil
+}
+
+// Matching returns the sinks whose filter accepts msg, evaluating the filter
+// set exactly once per post.
+func (r *Router) Matching(msg BskyMessage) []*routedSink {
+	var matched []*routedSink
+	for _, route := range r.routes {
+		if route.filter.Match(msg) {
+			matched = append(matched, route)
+		}
+	}
+	return matched
+}
+
+// Named narrows matched down to the routes whose sink name appears in names,
+// for a --rules-script that wants to pick specific sinks for a post.
+func Named(matched []*routedSink, names []string) []*routedSink {
+	allow := toSet(names)
+	var narrowed []*routedSink
+	for _, route := range matched {
+		if allow[route.sink.Name()] {
+			narrowed = append(narrowed, route)
+		}
+	}
+	return narrowed
+}
+
+// Deliver dispatches post to every route in matched concurrently, waiting
+// for them all to finish. A sink's failure (even after retries) is logged,
+// not returned, so it doesn't affect delivery to the other sinks.
+func (r *Router) Deliver(ctx context.Context, matched []*routedSink, post RenderedPost) {
+	var wg sync.WaitGroup
+	for _, route := range matched {
+		wg.Add(1)
+		go func(route *routedSink) {
+			defer wg.Done()
+			if err := route.deliverWithRetry(ctx, post); err != nil {
+				slog.Error("sink delivery failed", "sink", route.sink.Name(), "err", err)
+			}
+		}(route)
+	}
+	wg.Wait()
+}
+
+// maxDeliverAttempts bounds the retries applied to a single sink delivery.
+const maxDeliverAttempts = 3
+
+// deliverWithRetry delivers post to the sink, retrying transient failures a
+// few times with linear backoff. Every attempt (including the first) is rate
+// limited, so a flaky sink can't be hammered by repeated retries.
+func (rs *routedSink) deliverWithRetry(ctx context.Context, post RenderedPost) error {
+	var lastErr error
+	for attempt := 1; attempt <= maxDeliverAttempts; attempt++ {
+		if err := rs.limiter.Wait(ctx); err != nil {
+			return err
+		}
+		if err := rs.sink.Deliver(ctx, post); err != nil {
+			lastErr = err
+			slog.Warn("sink delivery attempt failed", "sink", rs.sink.Name(), "attempt", attempt, "err", err)
+			if attempt == maxDeliverAttempts {
+				break
+			}
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(time.Duration(attempt) * time.Second):
+			}
+			continue
+		}
+		return nil
+	}
+	return lastErr
+}
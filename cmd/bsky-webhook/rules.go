@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/d5/tengo/v2"
+)
+
+// ruleTimeout bounds how long a single rules-script evaluation may run, so a
+// slow or buggy script can't stall the message-reading loop.
+const ruleTimeout = 50 * time.Millisecond
+
+// maxRuleAllocs and maxRuleConstObjects bound a rules script's resource use,
+// so a bad script can waste CPU but can't exhaust memory.
+const (
+	maxRuleAllocs       = 1 << 16
+	maxRuleConstObjects = 1 << 12
+)
+
+// RuleResult is the decision a rules script makes about one post. Every
+// field is optional: a script that sets nothing leaves routing entirely to
+// the configured sink filters.
+type RuleResult struct {
+	Drop bool // if true, the post is discarded before any sink sees it
+
+	// Sinks, if non-empty, restricts delivery to sinks with these names,
+	// further narrowing whatever the sink filters already matched.
+	Sinks []string
+
+	// TextOverride, if HasTextOverride, replaces the post text used to
+	// render (but not deliver) the post.
+	TextOverride    string
+	HasTextOverride bool
+
+	Tags []string // free-form labels the script wants attached to the post
+}
+
+// RulesEngine runs a user-supplied Tengo script against every candidate post,
+// ahead of the configured sink filters. The script is compiled once at
+// startup; each call to Eval clones the compiled bytecode, so concurrent
+// Jetstream messages never share VM state.
+type RulesEngine struct {
+	compiled *tengo.Compiled
+}
+
+// NewRulesEngine compiles the Tengo script at path. Call Eval for every
+// subsequent post.
+func NewRulesEngine(path string) (*RulesEngine, error) {
+	src, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	s := tengo.NewScript(src)
+	s.SetMaxAllocs(maxRuleAllocs)
+	s.SetMaxConstObjects(maxRuleConstObjects)
+	if err := s.Add("post", map[string]interface{}{}); err != nil {
+		return nil, fmt.Errorf("declare post global: %w", err)
+	}
+	compiled, err := s.Compile()
+	if err != nil {
+		return nil, fmt.Errorf("compile %s: %w", path, err)
+	}
+	return &RulesEngine{compiled: compiled}, nil
+}
+
+// Eval runs the script against msg (and handle, if the caller has already
+// resolved one) and returns its routing decision. It runs in a clone of the
+// compiled script, so it's safe to call concurrently from multiple
+// goroutines.
+func (e *RulesEngine) Eval(ctx context.Context, msg BskyMessage, handle string) (RuleResult, error) {
+	run := e.compiled.Clone()
+	if err := run.Set("post", postToTengoValue(msg, handle)); err != nil {
+		return RuleResult{}, fmt.Errorf("set post global: %w", err)
+	}
+
+	runCtx, cancel := context.WithTimeout(ctx, ruleTimeout)
+	defer cancel()
+	if err := run.RunContext(runCtx); err != nil {
+		return RuleResult{}, fmt.Errorf("run rules script: %w", err)
+	}
+
+	return ruleResultFromCompiled(run), nil
+}
+
+// postToTengoValue builds the value exposed to the script as `post`. The
+// script only ever sees a copy, so it can't mutate msg.
+func postToTengoValue(msg BskyMessage, handle string) map[string]interface{} {
+	var facets []interface{}
+	for _, f := range msg.Commit.Record.Facets {
+		var features []interface{}
+		for _, feat := range f.Features {
+			features = append(features, map[string]interface{}{
+				"type": feat.Type,
+				"uri":  feat.URI,
+				"did":  feat.DID,
+				"tag":  feat.Tag,
+			})
+		}
+		facets = append(facets, map[string]interface{}{
+			"features":   features,
+			"byte_start": int64(f.Index.ByteStart),
+			"byte_end":   int64(f.Index.ByteEnd),
+		})
+	}
+
+	var images []interface{}
+	for _, img := range msg.Commit.Record.Embed.Images {
+		images = append(images, fmt.Sprintf("https://cdn.bsky.app/img/feed_fullsize/plain/%s/%s", msg.DID, img.Image.Ref.Link))
+	}
+
+	var langs []interface{}
+	for _, l := range msg.Commit.Record.Langs {
+		langs = append(langs, l)
+	}
+
+	return map[string]interface{}{
+		"text":       msg.Commit.Record.Text,
+		"facets":     facets,
+		"images":     images,
+		"did":        msg.DID,
+		"handle":     handle,
+		"created_at": msg.Commit.Record.CreatedAt,
+		"langs":      langs,
+	}
+}
+
+// ruleResultFromCompiled reads the script's output globals (drop, sinks,
+// text_override, tags) back out of run after it has executed.
+func ruleResultFromCompiled(run *tengo.Compiled) RuleResult {
+	var result RuleResult
+
+	if v := run.Get("drop"); !v.IsUndefined() {
+		result.Drop = v.Bool()
+	}
+	if v := run.Get("sinks"); !v.IsUndefined() {
+		for _, s := range v.Array() {
+			if name, ok := s.(string); ok {
+				result.Sinks = append(result.Sinks, name)
+			}
+		}
+	}
+	if v := run.Get("text_override"); !v.IsUndefined() {
+		result.TextOverride = v.String()
+		result.HasTextOverride = true
+	}
+	if v := run.Get("tags"); !v.IsUndefined() {
+		for _, t := range v.Array() {
+			if tag, ok := t.(string); ok {
+				result.Tags = append(result.Tags, tag)
+			}
+		}
+	}
+
+	return result
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	bluesky "github.com/tailscale/go-bluesky"
+)
+
+// RenderedPost carries everything a Sink needs to render and deliver a
+// matched Bluesky post, independent of the destination platform's format.
+type RenderedPost struct {
+	Message  BskyMessage
+	Profile  bluesky.Profile
+	ImageURL string
+	PostTime time.Time
+	Tags     []string // labels attached by a --rules-script, if any
+}
+
+// Sink delivers a single matched post to one chat platform or webhook.
+type Sink interface {
+	// Name identifies the sink in logs, e.g. "slack" or a configured name.
+	Name() string
+	Deliver(ctx context.Context, post RenderedPost) error
+}
+
+// postJSON POSTs body as JSON to url and returns an error unless the server
+// answers with 2xx.
+func postJSON(ctx context.Context, client *http.Client, url string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode/100 != 2 {
+		respBody, _ := io.ReadAll(res.Body)
+		return fmt.Errorf("%s: %s", res.Status, respBody)
+	}
+	return nil
+}
+
+// SlackSink delivers posts via a Slack incoming webhook, using the existing
+// attachment-based markup.
+type SlackSink struct {
+	httpClient *http.Client
+	webhookURL string
+	name       string
+}
+
+func (s *SlackSink) Name() string {
+	if s.name != "" {
+		return s.name
+	}
+	return "slack"
+}
+
+func (s *SlackSink) Deliver(ctx context.Context, post RenderedPost) error {
+	messageText, err := bskyMessageToSlackMarkup(post.Message)
+	if err != nil {
+		return err
+	}
+
+	body, err := json.Marshal(SlackBody{
+		UnfurlLinks: true,
+		UnfurlMedia: true,
+		Attachments: []SlackAttachment{
+			{
+				AuthorName: fmt.Sprintf("%s (@%s)", post.Profile.Name, post.Profile.Handle),
+				AuthorIcon: post.Profile.AvatarURL,
+				AuthorLink: fmt.Sprintf("https://bsky.app/profile/%s", post.Profile.Handle),
+				Text:       fmt.Sprintf("%s\n<%s|View post on Bluesky ↗>", messageText, post.Message.toURL(&post.Profile.Handle)),
+				ImageUrl:   post.ImageURL,
+				Footer:     "Posted",
+				Ts:         strconv.FormatInt(post.PostTime.Unix(), 10),
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	return postJSON(ctx, s.httpClient, s.webhookURL, body)
+}
+
+// DiscordSink delivers posts as a native Discord embed via a Discord
+// incoming webhook.
+type DiscordSink struct {
+	httpClient *http.Client
+	webhookURL string
+	name       string
+}
+
+func (s *DiscordSink) Name() string {
+	if s.name != "" {
+		return s.name
+	}
+	return "discord"
+}
+
+type discordWebhookBody struct {
+	Embeds []discordEmbed `json:"embeds"`
+}
+
+type discordEmbed struct {
+	Author      discordEmbedAuthor `json:"author"`
+	Description string             `json:"description"`
+	URL         string             `json:"url"`
+	Timestamp   string             `json:"timestamp"`
+	Image       *discordEmbedImage `json:"image,omitempty"`
+}
+
+type discordEmbedAuthor struct {
+	Name    string `json:"name"`
+	URL     string `json:"url"`
+	IconURL string `json:"icon_url"`
+}
+
+type discordEmbedImage struct {
+	URL string `json:"url"`
+}
+
+func (s *DiscordSink) Deliver(ctx context.Context, post RenderedPost) error {
+	messageText, err := bskyMessageToDiscordMarkup(post.Message)
+	if err != nil {
+		return err
+	}
+
+	embed := discordEmbed{
+		Author: discordEmbedAuthor{
+			Name:    fmt.Sprintf("%s (@%s)", post.Profile.Name, post.Profile.Handle),
+			URL:     fmt.Sprintf("https://bsky.app/profile/%s", post.Profile.Handle),
+			IconURL: post.Profile.AvatarURL,
+		},
+		Description: fmt.Sprintf("%s\n\n[View post on Bluesky ↗](%s)", messageText, post.Message.toURL(&post.Profile.Handle)),
+		URL:         post.Message.toURL(&post.Profile.Handle),
+		Timestamp:   post.PostTime.Format(time.RFC3339),
+	}
+	if post.ImageURL != "" {
+		embed.Image = &discordEmbedImage{URL: post.ImageURL}
+	}
+
+	body, err := json.Marshal(discordWebhookBody{Embeds: []discordEmbed{embed}})
+	if err != nil {
+		return err
+	}
+	return postJSON(ctx, s.httpClient, s.webhookURL, body)
+}
+
+// MatrixSink delivers posts as an m.room.message event to a Matrix room.
+type MatrixSink struct {
+	httpClient    *http.Client
+	homeserverURL string
+	accessToken   string
+	roomID        string
+	name          string
+
+	txnSeq atomic.Int64
+}
+
+func (s *MatrixSink) Name() string {
+	if s.name != "" {
+		return s.name
+	}
+	return "matrix"
+}
+
+type matrixMessageEvent struct {
+	MsgType       string `json:"msgtype"`
+	Body          string `json:"body"`
+	Format        string `json:"format,omitempty"`
+	FormattedBody string `json:"formatted_body,omitempty"`
+}
+
+func (s *MatrixSink) Deliver(ctx context.Context, post RenderedPost) error {
+	formattedBody, err := bskyMessageToMatrixHTML(post.Message)
+	if err != nil {
+		return err
+	}
+
+	url := post.Message.toURL(&post.Profile.Handle)
+	event := matrixMessageEvent{
+		MsgType:       "m.text",
+		Body:          fmt.Sprintf("%s (@%s): %s\n%s", post.Profile.Name, post.Profile.Handle, post.Message.Commit.Record.Text, url),
+		Format:        "org.matrix.custom.html",
+		FormattedBody: fmt.Sprintf("<strong>%s (@%s)</strong>: %s<br><a href=\"%s\">View post on Bluesky</a>", html.EscapeString(post.Profile.Name), html.EscapeString(post.Profile.Handle), formattedBody, html.EscapeString(url)),
+	}
+
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	txnID := s.txnSeq.Add(1)
+	target := fmt.Sprintf("%s/_matrix/client/v3/rooms/%s/send/m.room.message/bsky-webhook-%d", strings.TrimSuffix(s.homeserverURL, "/"), s.roomID, txnID)
+
+	req, err := http.NewRequestWithContext(ctx, "PUT", target, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+s.accessToken)
+
+	res, err := s.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode/100 != 2 {
+		respBody, _ := io.ReadAll(res.Body)
+		return fmt.Errorf("%s: %s", res.Status, respBody)
+	}
+	return nil
+}
+
+// IRCSink delivers posts as a plain-text line to an HTTP-based IRC relay
+// (e.g. a bouncer or bridge bot that accepts {"text": "..."} and forwards it
+// to a channel). The project has no raw IRC client dependency, so delivery
+// goes through such a bridge rather than a direct socket connection.
+type IRCSink struct {
+	httpClient *http.Client
+	bridgeURL  string
+	name       string
+}
+
+func (s *IRCSink) Name() string {
+	if s.name != "" {
+		return s.name
+	}
+	return "irc"
+}
+
+// maxIRCLineBytes approximates the classic 512-byte IRC protocol line limit,
+// leaving room for the relay's own framing.
+const maxIRCLineBytes = 400
+
+// truncateUTF8 cuts s to at most n bytes without splitting a multi-byte rune.
+func truncateUTF8(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+func (s *IRCSink) Deliver(ctx context.Context, post RenderedPost) error {
+	text := strings.ReplaceAll(post.Message.Commit.Record.Text, "\n", " ")
+	line := fmt.Sprintf("[bsky] %s (@%s): %s - %s", post.Profile.Name, post.Profile.Handle, text, post.Message.toURL(&post.Profile.Handle))
+	if len(line) > maxIRCLineBytes {
+		line = truncateUTF8(line, maxIRCLineBytes-1) + "…"
+	}
+
+	body, err := json.Marshal(struct {
+		Text string `json:"text"`
+	}{Text: line})
+	if err != nil {
+		return err
+	}
+	return postJSON(ctx, s.httpClient, s.bridgeURL, body)
+}
+
+// WebhookSink delivers the raw post data as generic JSON, for operators who
+// want to wire up their own consumer.
+type WebhookSink struct {
+	httpClient *http.Client
+	url        string
+	name       string
+}
+
+func (s *WebhookSink) Name() string {
+	if s.name != "" {
+		return s.name
+	}
+	return "webhook"
+}
+
+type genericWebhookPayload struct {
+	DID       string `json:"did"`
+	Handle    string `json:"handle"`
+	Text      string `json:"text"`
+	URL       string `json:"url"`
+	ImageURL  string `json:"image_url,omitempty"`
+	CreatedAt string `json:"created_at"`
+}
+
+func (s *WebhookSink) Deliver(ctx context.Context, post RenderedPost) error {
+	body, err := json.Marshal(genericWebhookPayload{
+		DID:       post.Message.DID,
+		Handle:    post.Profile.Handle,
+		Text:      post.Message.Commit.Record.Text,
+		URL:       post.Message.toURL(&post.Profile.Handle),
+		ImageURL:  post.ImageURL,
+		CreatedAt: post.PostTime.Format(time.RFC3339),
+	})
+	if err != nil {
+		return err
+	}
+	return postJSON(ctx, s.httpClient, s.url, body)
+}
@@ -33,6 +33,7 @@ type BskyRecord struct {
 	Embed     BskyEmbed   `json:"embed"`
 	CreatedAt string      `json:"createdAt"` // RFC3339 timestamp
 	Facets    []BskyFacet `json:"facets"`
+	Langs     []string    `json:"langs"` // BCP-47 language tags self-reported by the poster
 }
 
 type BskyEmbed struct {
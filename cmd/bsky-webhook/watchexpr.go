@@ -0,0 +1,382 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"unicode"
+)
+
+// WatchExpr is a compiled boolean watch expression, e.g.
+// `("tailscale" OR "headscale") AND NOT "spam" AND lang:en`. It supports
+// bare terms, quoted phrases, field-qualified terms (hashtag:, mention:,
+// lang:, domain:), the operators AND/OR/NOT, parentheses, and an optional
+// trailing `*` on a term or field value for prefix matching. Matching is
+// whole-word and case-folded.
+type WatchExpr struct {
+	root watchNode
+	src  string
+}
+
+// ParseWatchExpr compiles expr. A bare word with no operators (e.g.
+// "tailscale") is itself a valid expression matching that single word.
+func ParseWatchExpr(expr string) (*WatchExpr, error) {
+	toks, err := tokenizeWatchExpr(expr)
+	if err != nil {
+		return nil, fmt.Errorf("watch expression %q: %w", expr, err)
+	}
+	root, err := parseWatchTokens(toks)
+	if err != nil {
+		return nil, fmt.Errorf("watch expression %q: %w", expr, err)
+	}
+	return &WatchExpr{root: root, src: expr}, nil
+}
+
+// String returns the original, uncompiled expression text.
+func (w *WatchExpr) String() string { return w.src }
+
+// Match reports whether msg satisfies the expression.
+func (w *WatchExpr) Match(msg BskyMessage) bool {
+	return w.root.eval(buildWatchDoc(msg))
+}
+
+// watchDoc is the set of facts about a post that watchNodes can test.
+type watchDoc struct {
+	words        []string // casefolded word tokens from the post text
+	boundaryText string   // " word1 word2 ... " for word-bounded phrase search
+
+	langs    map[string]bool
+	hashtags map[string]bool
+	mentions map[string]bool
+	domains  map[string]bool
+}
+
+func buildWatchDoc(msg BskyMessage) *watchDoc {
+	var text string
+	if msg.Commit != nil && msg.Commit.Record != nil {
+		text = msg.Commit.Record.Text
+	}
+	words := tokenizeWatchWords(text)
+
+	doc := &watchDoc{
+		words:        words,
+		boundaryText: " " + strings.Join(words, " ") + " ",
+		langs:        make(map[string]bool),
+		hashtags:     make(map[string]bool),
+		mentions:     make(map[string]bool),
+		domains:      make(map[string]bool),
+	}
+	if msg.Commit == nil || msg.Commit.Record == nil {
+		return doc
+	}
+
+	for _, lang := range msg.Commit.Record.Langs {
+		doc.langs[normalizeWatchTerm(lang)] = true
+	}
+	for _, facet := range msg.Commit.Record.Facets {
+		for _, feat := range facet.Features {
+			switch {
+			case feat.Tag != "":
+				doc.hashtags[normalizeWatchTerm(feat.Tag)] = true
+			case feat.DID != "":
+				doc.mentions[normalizeWatchTerm(feat.DID)] = true
+			case feat.URI != "":
+				if u, err := url.Parse(feat.URI); err == nil && u.Hostname() != "" {
+					doc.domains[normalizeWatchTerm(u.Hostname())] = true
+				}
+			}
+		}
+	}
+	return doc
+}
+
+// tokenizeWatchWords splits s into casefolded words, using unicode.IsLetter
+// and unicode.IsDigit runs as word boundaries.
+func tokenizeWatchWords(s string) []string {
+	var words []string
+	var cur []rune
+	flush := func() {
+		if len(cur) > 0 {
+			words = append(words, strings.ToLower(string(cur)))
+			cur = cur[:0]
+		}
+	}
+	for _, r := range s {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			cur = append(cur, r)
+		} else {
+			flush()
+		}
+	}
+	flush()
+	return words
+}
+
+func normalizeWatchTerm(s string) string {
+	return strings.ToLower(strings.TrimSpace(s))
+}
+
+// watchNode is one node of a compiled expression's AST.
+type watchNode interface {
+	eval(doc *watchDoc) bool
+}
+
+type watchAndNode struct{ left, right watchNode }
+
+func (n *watchAndNode) eval(doc *watchDoc) bool { return n.left.eval(doc) && n.right.eval(doc) }
+
+type watchOrNode struct{ left, right watchNode }
+
+func (n *watchOrNode) eval(doc *watchDoc) bool { return n.left.eval(doc) || n.right.eval(doc) }
+
+type watchNotNode struct{ child watchNode }
+
+func (n *watchNotNode) eval(doc *watchDoc) bool { return !n.child.eval(doc) }
+
+// watchTermNode matches a single casefolded word, optionally as a prefix.
+type watchTermNode struct {
+	word   string
+	prefix bool
+}
+
+func (n *watchTermNode) eval(doc *watchDoc) bool {
+	for _, w := range doc.words {
+		if n.prefix {
+			if strings.HasPrefix(w, n.word) {
+				return true
+			}
+		} else if w == n.word {
+			return true
+		}
+	}
+	return false
+}
+
+// watchPhraseNode matches a sequence of words appearing in order,
+// word-bounded, anywhere in the post text.
+type watchPhraseNode struct{ words []string }
+
+func (n *watchPhraseNode) eval(doc *watchDoc) bool {
+	if len(n.words) == 0 {
+		return false
+	}
+	needle := " " + strings.Join(n.words, " ") + " "
+	return strings.Contains(doc.boundaryText, needle)
+}
+
+// watchFieldNode matches a field-qualified term (hashtag:, mention:, lang:,
+// domain:) against the corresponding set on watchDoc.
+type watchFieldNode struct {
+	field  string
+	value  string
+	prefix bool
+}
+
+func (n *watchFieldNode) eval(doc *watchDoc) bool {
+	var set map[string]bool
+	switch n.field {
+	case "lang":
+		set = doc.langs
+	case "hashtag":
+		set = doc.hashtags
+	case "mention":
+		set = doc.mentions
+	case "domain":
+		set = doc.domains
+	default:
+		return false
+	}
+	if !n.prefix {
+		return set[n.value]
+	}
+	for v := range set {
+		if strings.HasPrefix(v, n.value) {
+			return true
+		}
+	}
+	return false
+}
+
+// watchTokKind identifies a lexical token kind in a watch expression.
+type watchTokKind int
+
+const (
+	watchTokTerm watchTokKind = iota
+	watchTokPhrase
+	watchTokField
+	watchTokAnd
+	watchTokOr
+	watchTokNot
+	watchTokLParen
+	watchTokRParen
+)
+
+type watchTok struct {
+	kind   watchTokKind
+	field  string // set when kind == watchTokField
+	text   string // term/phrase/field value
+	prefix bool   // trailing '*' on a term or field value
+}
+
+// isWatchField reports whether name is a recognized field qualifier.
+func isWatchField(name string) bool {
+	switch strings.ToLower(name) {
+	case "hashtag", "mention", "lang", "domain":
+		return true
+	}
+	return false
+}
+
+// tokenizeWatchExpr lexes expr into terms, phrases, field-qualified terms,
+// operators, and parentheses.
+func tokenizeWatchExpr(expr string) ([]watchTok, error) {
+	runes := []rune(expr)
+	var toks []watchTok
+
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+
+		case r == '(':
+			toks = append(toks, watchTok{kind: watchTokLParen})
+			i++
+
+		case r == ')':
+			toks = append(toks, watchTok{kind: watchTokRParen})
+			i++
+
+		case r == '"':
+			j := i + 1
+			for j < len(runes) && runes[j] != '"' {
+				j++
+			}
+			if j >= len(runes) {
+				return nil, fmt.Errorf("unterminated quote")
+			}
+			toks = append(toks, watchTok{kind: watchTokPhrase, text: string(runes[i+1 : j])})
+			i = j + 1
+
+		default:
+			j := i
+			for j < len(runes) && !unicode.IsSpace(runes[j]) && runes[j] != '(' && runes[j] != ')' && runes[j] != '"' {
+				j++
+			}
+			raw := string(runes[i:j])
+			i = j
+
+			switch strings.ToUpper(raw) {
+			case "AND":
+				toks = append(toks, watchTok{kind: watchTokAnd})
+			case "OR":
+				toks = append(toks, watchTok{kind: watchTokOr})
+			case "NOT":
+				toks = append(toks, watchTok{kind: watchTokNot})
+			default:
+				prefix := strings.HasSuffix(raw, "*")
+				raw = strings.TrimSuffix(raw, "*")
+				if field, value, ok := strings.Cut(raw, ":"); ok && isWatchField(field) {
+					toks = append(toks, watchTok{kind: watchTokField, field: strings.ToLower(field), text: value, prefix: prefix})
+				} else {
+					toks = append(toks, watchTok{kind: watchTokTerm, text: raw, prefix: prefix})
+				}
+			}
+		}
+	}
+	return toks, nil
+}
+
+// watchPrec gives the binding strength of each binary/unary operator, for
+// the shunting-yard parse below. Higher binds tighter.
+var watchPrec = map[watchTokKind]int{
+	watchTokNot: 3,
+	watchTokAnd: 2,
+	watchTokOr:  1,
+}
+
+// parseWatchTokens runs the shunting-yard algorithm over toks, reducing
+// operators into AST nodes as soon as precedence allows rather than first
+// building an explicit postfix queue.
+func parseWatchTokens(toks []watchTok) (watchNode, error) {
+	var output []watchNode
+	var ops []watchTokKind
+
+	apply := func() error {
+		op := ops[len(ops)-1]
+		ops = ops[:len(ops)-1]
+
+		if op == watchTokNot {
+			if len(output) < 1 {
+				return fmt.Errorf("NOT missing operand")
+			}
+			child := output[len(output)-1]
+			output[len(output)-1] = &watchNotNode{child: child}
+			return nil
+		}
+
+		if len(output) < 2 {
+			return fmt.Errorf("operator missing operand")
+		}
+		right := output[len(output)-1]
+		left := output[len(output)-2]
+		output = output[:len(output)-2]
+		if op == watchTokAnd {
+			output = append(output, &watchAndNode{left: left, right: right})
+		} else {
+			output = append(output, &watchOrNode{left: left, right: right})
+		}
+		return nil
+	}
+
+	for _, t := range toks {
+		switch t.kind {
+		case watchTokTerm:
+			output = append(output, &watchTermNode{word: normalizeWatchTerm(t.text), prefix: t.prefix})
+		case watchTokPhrase:
+			output = append(output, &watchPhraseNode{words: tokenizeWatchWords(t.text)})
+		case watchTokField:
+			output = append(output, &watchFieldNode{field: t.field, value: normalizeWatchTerm(t.text), prefix: t.prefix})
+		case watchTokNot:
+			ops = append(ops, watchTokNot)
+		case watchTokAnd, watchTokOr:
+			for len(ops) > 0 && ops[len(ops)-1] != watchTokLParen && watchPrec[ops[len(ops)-1]] >= watchPrec[t.kind] {
+				if err := apply(); err != nil {
+					return nil, err
+				}
+			}
+			ops = append(ops, t.kind)
+		case watchTokLParen:
+			ops = append(ops, watchTokLParen)
+		case watchTokRParen:
+			closed := false
+			for len(ops) > 0 {
+				if ops[len(ops)-1] == watchTokLParen {
+					ops = ops[:len(ops)-1]
+					closed = true
+					break
+				}
+				if err := apply(); err != nil {
+					return nil, err
+				}
+			}
+			if !closed {
+				return nil, fmt.Errorf("unmatched )")
+			}
+		}
+	}
+
+	for len(ops) > 0 {
+		if ops[len(ops)-1] == watchTokLParen {
+			return nil, fmt.Errorf("unmatched (")
+		}
+		if err := apply(); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(output) != 1 {
+		return nil, fmt.Errorf("malformed expression")
+	}
+	return output[0], nil
+}